@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// androidTargets returns one android/<arch> target per entry of Android.Archs; callers join
+// them with commas for -target. An empty Archs list means "let gomobile pick its defaults", in which case
+// the plain "android" target is returned.
+func androidTargets(archs []string) []string {
+	if len(archs) == 0 {
+		return []string{"android"}
+	}
+	targets := make([]string, 0, len(archs))
+	for _, arch := range archs {
+		targets = append(targets, "android/"+arch)
+	}
+	return targets
+}
+
+// compileGomobileAndroid binds the android target, either as a single gomobile invocation or,
+// when Android.Parallel is set and more than one arch is configured, as one invocation per arch
+// merged into a single AAR afterwards.
+func (g *Goup) compileGomobileAndroid(outFile Path) error {
+	android := g.config.Build.Gomobile.Android
+	targets := androidTargets(android.Archs)
+
+	if !android.Parallel || len(targets) < 2 {
+		args := []string{"bind", "-v", "-o", outFile.String(), "-javapkg", g.androidJavapkg()}
+		args = append(args, "-target="+strings.Join(targets, ","))
+		args = append(args, g.config.Build.Gomobile.Export...)
+		_, err := g.Run("bin/gomobile", args...)
+		return err
+	}
+
+	return g.compileGomobileAndroidParallel(targets, outFile)
+}
+
+// compileGomobileAndroidParallel runs one "gomobile bind -target=android/<arch>" per arch
+// concurrently, each writing its AAR into its own work directory under buildDir (all of them run
+// from the current working directory), and merges the resulting AARs into outFile. Any failing arch cancels the others via ctx.
+func (g *Goup) compileGomobileAndroidParallel(targets []string, outFile Path) error {
+	android := g.config.Build.Gomobile.Android
+
+	sem := make(chan struct{}, runtime.NumCPU())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(targets))
+	aars := make([]Path, len(targets))
+
+	for i, target := range targets {
+		i, target := i, target
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			workDir := g.buildDir.Child("android-" + strings.ReplaceAll(target, "/", "-"))
+			_ = os.RemoveAll(workDir.String())
+			must(os.MkdirAll(workDir.String(), os.ModePerm))
+
+			aarOut := workDir.Child("out.aar")
+			args := []string{"bind", "-v", "-o", aarOut.String(), "-javapkg", g.androidJavapkg()}
+			args = append(args, "-target="+target)
+			args = append(args, g.config.Build.Gomobile.Export...)
+
+			// RunContext ties the child process lifetime to ctx, so cancel() (from a sibling
+			// arch failing) kills this build too instead of letting it run to completion.
+			_, err := g.RunContext(ctx, "bin/gomobile", args...)
+			if err != nil {
+				if ctx.Err() == nil {
+					cancel()
+					errs <- fmt.Errorf("failed to bind %s: %v", target, err)
+				}
+				return
+			}
+			aars[i] = aarOut
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return mergeAars(aars, outFile)
+}
+
+// mergeAars unions the jni/<abi>/ libraries and classes.jar entries of every AAR in aars into a
+// single AAR at outFile. Entries with the same name and the same SHA256 are deduplicated;
+// entries with the same name but different content collide, in which case the first one seen
+// wins and the collision is logged rather than silently writing two zip entries with the same
+// name.
+func mergeAars(aars []Path, outFile Path) error {
+	seen := make(map[string]string) // entry name -> sha256 hex of the copy already written
+
+	out, err := os.Create(outFile.String())
+	if err != nil {
+		return fmt.Errorf("failed to create merged aar: %v", err)
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	defer zw.Close()
+
+	for _, aar := range aars {
+		r, err := zip.OpenReader(aar.String())
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", aar, err)
+		}
+
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				r.Close()
+				return fmt.Errorf("failed to read %s from %s: %v", f.Name, aar, err)
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				r.Close()
+				return fmt.Errorf("failed to read %s from %s: %v", f.Name, aar, err)
+			}
+
+			sum := fmt.Sprintf("%x", sha256.Sum256(data))
+			if existing, ok := seen[f.Name]; ok {
+				if existing != sum {
+					logger.Debug(Fields{"mergeAars": "collision", "entry": f.Name, "aar": aar, "kept": existing, "dropped": sum})
+				}
+				continue
+			}
+			seen[f.Name] = sum
+
+			w, err := zw.Create(f.Name)
+			if err != nil {
+				r.Close()
+				return fmt.Errorf("failed to write %s: %v", f.Name, err)
+			}
+			if _, err := io.Copy(w, strings.NewReader(string(data))); err != nil {
+				r.Close()
+				return fmt.Errorf("failed to write %s: %v", f.Name, err)
+			}
+		}
+
+		r.Close()
+	}
+
+	return nil
+}
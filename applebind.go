@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// hasAppleBuild returns true if a gomobile apple section is defined and enabled
+func (g *Goup) hasAppleBuild() bool {
+	return g.config.Build.Gomobile.Apple != nil && !g.config.Build.Gomobile.Apple.Disabled && g.hasTarget("gomobile/apple")
+}
+
+// compileGomobileApple binds every platform configured in Apple.Platforms into a single
+// XCFramework, e.g. -target=ios,iossimulator,macos
+func (g *Goup) compileGomobileApple() error {
+	apple := g.config.Build.Gomobile.Apple
+
+	if len(apple.Out) == 0 {
+		apple.Out = Path("./" + g.config.Name + ".xcframework")
+	}
+	outFile := apple.Out.Resolve(g.args.BaseDir)
+
+	args := []string{"bind", "-v", "-o", outFile.String()}
+
+	if len(apple.Prefix) > 0 {
+		args = append(args, "-prefix", apple.Prefix)
+	}
+	if len(apple.Ldflags) > 0 {
+		args = append(args, "-ldflags", apple.Ldflags)
+	}
+
+	args = append(args, "-bundleid", g.appleBundleid())
+	args = append(args, "-target="+strings.Join(apple.Platforms, ","))
+
+	args = append(args, g.config.Build.Gomobile.Export...)
+	_, err := g.Run("bin/gomobile", args...)
+	return err
+}
+
+// compileGomobileIosLegacy preserves the pre-Apple behaviour of binding a single ios
+// target into a plain .framework, for users still on the deprecated Ios section.
+func (g *Goup) compileGomobileIosLegacy() error {
+	fmt.Fprintln(os.Stderr, "warning: Build.Gomobile.Ios is deprecated, use Build.Gomobile.Apple instead")
+
+	ios := g.config.Build.Gomobile.Ios
+	if len(ios.Out) == 0 {
+		ios.Out = Path("./" + g.config.Name + ".framework")
+	}
+	outFile := ios.Out.Resolve(g.args.BaseDir)
+
+	args := []string{"bind", "-v", "-o", outFile.String()}
+
+	if len(ios.Prefix) > 0 {
+		args = append(args, "-prefix", ios.Prefix)
+	}
+	args = append(args, "-bundleid", g.iosBundleidLegacy())
+	args = append(args, "-target=ios")
+
+	args = append(args, g.config.Build.Gomobile.Export...)
+	_, err := g.Run("bin/gomobile", args...)
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// withToolchainLock holds an exclusive flock on ~/.goup/toolchains/.lock for the duration of fn,
+// so that parallel goup invocations for different projects can share the toolchain cache without
+// corrupting it.
+func (g *Goup) withToolchainLock(fn func() error) error {
+	return withToolchainLockAt(g.args.HomeDir, fn)
+}
+
+// withToolchainLockAt is the standalone form of withToolchainLock for callers (e.g. GC) that
+// don't have a *Goup, but still need to hold the same lock that resolveToolchain takes while
+// resolving/symlinking toolchain directories under homeDir/toolchains.
+func withToolchainLockAt(homeDir Path, fn func() error) error {
+	toolchains := homeDir.Child("toolchains")
+	must(os.MkdirAll(toolchains.String(), os.ModePerm))
+
+	lockFile := toolchains.Child(".lock")
+	f, err := os.OpenFile(lockFile.String(), os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to open toolchain lock: %v", err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to acquire toolchain lock: %v", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// blobPath returns the content-addressed staging path for a given sha256 hex digest:
+// ~/.goup/cache/blobs/sha256/<hex>
+func (g *Goup) blobPath(sha256Hex string) Path {
+	return g.args.HomeDir.Child("cache").Child("blobs").Child("sha256").Child(sha256Hex)
+}
+
+// fetchToCache downloads and unpacks url into the content-addressed cache, keyed by its expected
+// sha256 digest, unless it is already present. Returns the cache directory holding the unpacked
+// archive. The download is verified in a temporary file and unpacked into a staging directory;
+// on success that is renamed into place atomically so a crash mid-download never leaves a half-valid cache entry.
+func (g *Goup) fetchToCache(url string, sha256Hex string) (Path, error) {
+	blob := g.blobPath(sha256Hex)
+	if blob.Exists() {
+		logger.Debug(Fields{"cache": "hit", "sha256": sha256Hex})
+		return blob, nil
+	}
+
+	staging := Path(blob.String() + ".staging-" + filepath.Base(url))
+	_ = os.RemoveAll(staging.String())
+	must(os.MkdirAll(staging.String(), os.ModePerm))
+
+	err := downloadAndUnpack(url, sha256Hex, staging)
+	if err != nil {
+		_ = os.RemoveAll(staging.String())
+		return "", err
+	}
+
+	must(os.MkdirAll(blob.Parent().String(), os.ModePerm))
+	if err := os.Rename(staging.String(), blob.String()); err != nil {
+		return "", fmt.Errorf("failed to move %s into cache: %v", staging, err)
+	}
+
+	return blob, nil
+}
+
+// GC removes toolchain directories under homeDir/toolchains that are no longer referenced by any
+// goup.yaml found under roots. This backs the "goup gc <root>..." subcommand. The list+delete pass
+// runs under the same toolchain flock that resolveToolchain holds while resolving/symlinking those
+// directories, so it never races with a concurrent invocation resolving them. The lock is not held
+// for the rest of a build, so a toolchain in use by a project outside roots can still be removed.
+func GC(homeDir Path, roots []Path) error {
+	referenced, err := referencedToolchains(roots)
+	if err != nil {
+		return err
+	}
+
+	return withToolchainLockAt(homeDir, func() error {
+		toolchains := homeDir.Child("toolchains")
+		entries, err := ioutil.ReadDir(toolchains.String())
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to list toolchains: %v", err)
+		}
+
+		for _, entry := range entries {
+			// resolveToolchain places toolchains as symlinks into the blob cache, so those count too
+			if (!entry.IsDir() && entry.Mode()&os.ModeSymlink == 0) || entry.Name() == ".lock" {
+				continue
+			}
+			if referenced[entry.Name()] {
+				logger.Debug(Fields{"gc": "keep", "toolchain": entry.Name()})
+				continue
+			}
+			logger.Debug(Fields{"gc": "remove", "toolchain": entry.Name()})
+			if err := os.RemoveAll(toolchains.Child(entry.Name()).String()); err != nil {
+				return fmt.Errorf("failed to remove %s: %v", entry.Name(), err)
+			}
+		}
+		return nil
+	})
+}
+
+// referencedToolchains walks roots for goup.yaml files and returns the set of toolchain
+// directory names (e.g. "go-1.12.4") they declare.
+func referencedToolchains(roots []Path) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	for _, root := range roots {
+		err := filepath.Walk(root.String(), func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(p, "goup.yaml") {
+				return nil
+			}
+
+			config := &GoUpConfiguration{}
+			if err := config.Load(Path(p)); err != nil {
+				logger.Debug(Fields{"gc": "skip", "file": p, "error": err.Error()})
+				return nil
+			}
+			if config.Build == nil || config.Build.Gomobile == nil {
+				return nil
+			}
+
+			toolchain := config.Build.Gomobile.Toolchain
+			goVersion := toolchain.Go
+			if IsEmpty(goVersion) {
+				goVersion = defaultGoVersion
+			}
+			referenced["go-"+goVersion] = true
+
+			ndkVersion := toolchain.Ndk
+			if IsEmpty(ndkVersion) {
+				ndkVersion = defaultNdkVersion
+			}
+			referenced["ndk-"+ndkVersion] = true
+
+			sdkVersion := toolchain.Sdk
+			if IsEmpty(sdkVersion) {
+				sdkVersion = defaultSdkVersion
+			}
+			referenced["sdk-"+sdkVersion] = true
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk %s: %v", root, err)
+		}
+	}
+
+	return referenced, nil
+}
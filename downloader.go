@@ -1,5 +1,20 @@
 package main
 
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
 // A Downloader downloads stuff like a zip folder and unpacks it into a the context of GoUp
 type Downloader interface {
 	// Performs the Download, or fails
@@ -12,3 +27,130 @@ type GoDownloader struct {
 func (GoDownloader) Download(gp *GoUp) error {
 	return nil
 }
+
+// downloadAndUnpack downloads url, streaming the response body through sha256 while writing it
+// to a temporary file so that the digest can be verified before anything is unpacked. If
+// expectedSha256 is empty, no verification is performed (e.g. for resources without a known
+// digest yet). The archive is then unpacked into target, which must already exist.
+func downloadAndUnpack(url string, expectedSha256 string, target Path) error {
+	res, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %v", url, err)
+	}
+	defer res.Body.Close()
+
+	tmpFile, err := os.CreateTemp("", "goup-download-*"+path.Ext(url))
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hasher), res.Body); err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+
+	if len(expectedSha256) > 0 {
+		actual := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(actual, expectedSha256) {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", url, expectedSha256, actual)
+		}
+	}
+
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind downloaded file: %v", err)
+	}
+
+	switch {
+	case strings.HasSuffix(url, ".zip"):
+		return unzip(tmpFile.Name(), target)
+	case strings.HasSuffix(url, ".tar.gz") || strings.HasSuffix(url, ".tgz"):
+		return untargz(tmpFile, target)
+	default:
+		return fmt.Errorf("unsupported archive format: %s", url)
+	}
+}
+
+// unzip extracts a zip archive at src into target
+func unzip(src string, target Path) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return fmt.Errorf("failed to open zip %s: %v", src, err)
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		dest := target.Child(f.Name)
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(dest.String(), os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest.String()), os.ModePerm); err != nil {
+			return err
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("failed to read %s from zip: %v", f.Name, err)
+		}
+
+		out, err := os.OpenFile(dest.String(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		if err != nil {
+			rc.Close()
+			return fmt.Errorf("failed to create %s: %v", dest, err)
+		}
+
+		_, err = io.Copy(out, rc)
+		rc.Close()
+		out.Close()
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// untargz extracts a gzip-compressed tar archive from r into target
+func untargz(r io.Reader, target Path) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to open gzip stream: %v", err)
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %v", err)
+		}
+
+		dest := target.Child(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest.String(), os.ModePerm); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dest.String()), os.ModePerm); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(dest.String(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return fmt.Errorf("failed to create %s: %v", dest, err)
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+			}
+		}
+	}
+}
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Default toolchain versions used when a project's goup.yaml leaves Toolchain.Go/Ndk/Sdk
+// unset. referencedToolchains (cache.go) must apply the same defaults, or "goup gc" will treat
+// a project's actually-used toolchain as unreferenced and delete it.
+const (
+	defaultGoVersion  = "1.12.4"
+	defaultNdkVersion = "r19c"
+	defaultSdkVersion = "433796"
+)
+
 // Goup contains the actual state of the goup program
 type Goup struct {
 	// The program arguments
@@ -112,88 +125,91 @@ func (g *Goup) loadResources() (*Resources, error) {
 	return res, nil
 }
 
-// prepareGomobileToolchain downloads go, ndk and sdk
+// prepareGomobileToolchain provides go, ndk and sdk, either by downloading them from
+// resources.xml or, when an external path is configured in BuildGomobileToolchain, by reusing an
+// already installed toolchain.
 func (g *Goup) prepareGomobileToolchain() error {
-	resources := make([]Resource, 0)
+	toolchain := g.config.Build.Gomobile.Toolchain
 
-	goVersion := g.config.Build.Gomobile.Toolchain.Go
+	goVersion := toolchain.Go
 	if IsEmpty(goVersion) {
-		goVersion = "1.12.4"
+		goVersion = defaultGoVersion
 	}
-	res, err := g.resources.Get("go", goVersion)
-	if err != nil {
-		return fmt.Errorf("cannot prepare android build: %v", err)
-	}
-	resources = append(resources, res)
 
-	ndkVersion := g.config.Build.Gomobile.Toolchain.Ndk
+	ndkVersion := toolchain.Ndk
 	if IsEmpty(ndkVersion) {
-		ndkVersion = "r19c"
-	}
-	res, err = g.resources.Get("ndk", ndkVersion)
-	if err != nil {
-		return fmt.Errorf("cannot prepare android build: %v", err)
-	}
-	if g.hasAndroidBuild() {
-		resources = append(resources, res)
+		ndkVersion = defaultNdkVersion
 	}
 
-	sdkVersion := g.config.Build.Gomobile.Toolchain.Sdk
+	sdkVersion := toolchain.Sdk
 	if IsEmpty(sdkVersion) {
-		sdkVersion = "433796"
-	}
-	res, err = g.resources.Get("sdk", sdkVersion)
-	if err != nil {
-		return fmt.Errorf("cannot prepare android build: %v", err)
-	}
-	if g.hasAndroidBuild() {
-		resources = append(resources, res)
+		sdkVersion = defaultSdkVersion
 	}
 
-	for _, res := range resources {
-		targetFolder := g.args.HomeDir.Child("toolchains").Child(res.Name + "-" + res.Version)
-		if targetFolder.Exists() {
-			logger.Debug(Fields{"toolchain": res.String(), "status": "exists"})
-			continue
+	ndkPath := toolchain.NdkPath
+	if IsEmpty(string(ndkPath)) {
+		// fall back to an NDK already installed via the Android SDK manager, mirroring
+		// gomobile's own external-NDK lookup
+		sdkNdk := g.args.HomeDir.Child("toolchains").Child("sdk-"+sdkVersion).Child("ndk").Child(ndkVersion)
+		if !IsEmpty(g.env["ANDROID_HOME"]) {
+			sdkNdk = Path(g.env["ANDROID_HOME"]).Child("ndk").Child(ndkVersion)
 		}
-
-		tmpTargetFolder := Path(targetFolder.String() + ".tmp")
-		_ = os.RemoveAll(tmpTargetFolder.String())
-		must(os.MkdirAll(tmpTargetFolder.String(), os.ModePerm))
-
-		err := downloadAndUnpack(res.Url, tmpTargetFolder)
-		if err != nil {
-			return fmt.Errorf("failed to provide resource: %s: %v", res.String(), err)
+		if sdkNdk.Exists() {
+			ndkPath = sdkNdk
 		}
+	}
 
-		files, err := ioutil.ReadDir(tmpTargetFolder.String())
-		if err != nil {
-			return err
-		}
-		if len(files) == 0 {
-			return fmt.Errorf("no files in resource: %s", res.String())
-		}
+	var goRoot, ndkRoot, sdkRoot Path
+	err := g.withToolchainLock(func() error {
+		var wg sync.WaitGroup
+		errs := make(chan error, 3)
 
-		// just unwrap additional folder
-		if len(files) == 1 && files[0].IsDir() {
-			err := os.Rename(tmpTargetFolder.Child(files[0].Name()).String(), targetFolder.String())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			root, err := g.resolveToolchain("go", goVersion, toolchain.GoPath)
 			if err != nil {
-				return err
+				errs <- fmt.Errorf("cannot prepare go toolchain: %v", err)
+				return
 			}
-		} else {
-			// already at root
-			err := os.Rename(tmpTargetFolder.String(), targetFolder.String())
+			goRoot = root
+		}()
+
+		if g.hasAndroidBuild() {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				root, err := g.resolveToolchain("ndk", ndkVersion, ndkPath)
+				if err != nil {
+					errs <- fmt.Errorf("cannot prepare ndk toolchain: %v", err)
+					return
+				}
+				ndkRoot = root
+			}()
+			go func() {
+				defer wg.Done()
+				root, err := g.resolveToolchain("sdk", sdkVersion, toolchain.SdkPath)
+				if err != nil {
+					errs <- fmt.Errorf("cannot prepare sdk toolchain: %v", err)
+					return
+				}
+				sdkRoot = root
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+		for err := range errs {
 			if err != nil {
 				return err
 			}
 		}
-
-		_ = os.RemoveAll(tmpTargetFolder.String())
-
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	goRoot := g.args.HomeDir.Child("toolchains").Child("go-" + goVersion)
-
 	g.setEnv("GOROOT", goRoot.String())
 	g.setEnv("GOPATH", g.goPath().String())
 	g.setEnv("PATH", goRoot.Child("bin").String()+":"+g.goPath().Child("bin").String()+":"+g.env["PATH"])
@@ -204,13 +220,105 @@ func (g *Goup) prepareGomobileToolchain() error {
 
 	_, _ = g.Run("which", "go")
 
-	g.setEnv("ANDROID_NDK_HOME", g.args.HomeDir.Child("toolchains").Child("ndk-" + ndkVersion).String())
-	g.setEnv("NDK_PATH", g.env["ANDROID_NDK_HOME"])
-	g.setEnv("ANDROID_HOME", g.args.HomeDir.Child("toolchains").Child("sdk-" + sdkVersion).String())
+	if g.hasAndroidBuild() {
+		g.setEnv("ANDROID_NDK_HOME", ndkRoot.String())
+		g.setEnv("NDK_PATH", g.env["ANDROID_NDK_HOME"])
+		g.setEnv("ANDROID_HOME", sdkRoot.String())
+	}
 
 	return nil
 }
 
+// resolveToolchain returns the root directory of the requested toolchain (kind being one of
+// "go", "ndk" or "sdk"). When externalPath is set it is validated and used as-is, skipping the
+// download entirely. Otherwise the matching entry is looked up in resources.xml and fetched into
+// the content-addressed blob cache (verifying its mandatory Sha256 digest), then symlinked into
+// place under ~/.goup/toolchains so that a partial download never leaves a half-valid directory
+// and concurrent goup invocations can share the same cached blob. Callers must hold
+// withToolchainLock while calling this.
+func (g *Goup) resolveToolchain(kind string, version string, externalPath Path) (Path, error) {
+	if !IsEmpty(string(externalPath)) {
+		if !externalPath.Exists() {
+			return "", fmt.Errorf("%s path %s does not exist", kind, externalPath)
+		}
+		if err := g.validateToolchainVersion(kind, externalPath, version); err != nil {
+			return "", fmt.Errorf("%s path %s: %v", kind, externalPath, err)
+		}
+		logger.Debug(Fields{"toolchain": kind, "version": version, "external": externalPath})
+		return externalPath, nil
+	}
+
+	res, err := g.resources.Get(kind, version)
+	if err != nil {
+		return "", err
+	}
+
+	targetFolder := g.args.HomeDir.Child("toolchains").Child(res.Name + "-" + res.Version)
+	if targetFolder.Exists() {
+		logger.Debug(Fields{"toolchain": res.String(), "status": "exists"})
+		return targetFolder, nil
+	}
+
+	if IsEmpty(res.Sha256) {
+		return "", fmt.Errorf("resource %s has no sha256 digest, refusing to download it untrusted", res.String())
+	}
+
+	blob, err := g.fetchToCache(res.Url, res.Sha256)
+	if err != nil {
+		return "", fmt.Errorf("failed to provide resource: %s: %v", res.String(), err)
+	}
+
+	files, err := ioutil.ReadDir(blob.String())
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no files in resource: %s", res.String())
+	}
+
+	must(os.MkdirAll(targetFolder.Parent().String(), os.ModePerm))
+
+	// just unwrap additional folder
+	linkSource := blob
+	if len(files) == 1 && files[0].IsDir() {
+		linkSource = blob.Child(files[0].Name())
+	}
+	if err := os.Symlink(linkSource.String(), targetFolder.String()); err != nil {
+		return "", err
+	}
+
+	return targetFolder, nil
+}
+
+// validateToolchainVersion checks that an externally configured toolchain path actually
+// contains the version the project asked for, so a misconfigured GoPath/NdkPath/SdkPath fails
+// fast instead of being silently accepted.
+func (g *Goup) validateToolchainVersion(kind string, path Path, version string) error {
+	switch kind {
+	case "go":
+		lines, err := g.Run(path.Child("bin").Child("go").String(), "version")
+		if err != nil {
+			return fmt.Errorf("failed to run go version: %v", err)
+		}
+		if !strings.Contains(strings.Join(lines, "\n"), "go"+version) {
+			return fmt.Errorf("expected go version %s, got: %s", version, strings.Join(lines, " "))
+		}
+		return nil
+	case "ndk", "sdk":
+		props := path.Child("source.properties")
+		data, err := ioutil.ReadFile(props.String())
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", props, err)
+		}
+		if !strings.Contains(string(data), version) {
+			return fmt.Errorf("%s does not mention expected version %s", props, version)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown toolchain kind: %s", kind)
+	}
+}
+
 // goPath returns the artificial goPath
 func (g *Goup) goPath() Path {
 	return g.buildDir.Child("go")
@@ -230,7 +338,14 @@ func (g *Goup) chmodX(path Path) error {
 }
 
 func (g *Goup) Run(name string, args ...string) ([]string, error) {
-	cmd := exec.Command(name, args...)
+	return g.RunContext(context.Background(), name, args...)
+}
+
+// RunContext behaves like Run but kills the child process as soon as ctx is done, so that a
+// shared context can cancel an in-flight external command rather than only preventing new ones
+// from starting.
+func (g *Goup) RunContext(ctx context.Context, name string, args ...string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
 
 	fields := Fields{}
 	for k, v := range g.env {
@@ -261,6 +376,50 @@ func (g *Goup) Run(name string, args ...string) ([]string, error) {
 	return lines, err
 }
 
+func (g *Goup) RunOutput(name string, args ...string) ([]string, error) {
+	return g.RunOutputContext(context.Background(), name, args...)
+}
+
+// RunOutputContext behaves like RunContext, but keeps stdout and stderr separate instead of
+// merging them, returning only stdout split into lines. Callers that need to parse stdout as
+// structured data (e.g. JSON) must use this instead of RunContext/Run: some commands (e.g. "go
+// mod download") write progress output to stderr even when stdout is machine-readable, and
+// merging the two streams would corrupt the parse.
+func (g *Goup) RunOutputContext(ctx context.Context, name string, args ...string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	fields := Fields{}
+	for k, v := range g.env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+		fields[k] = v
+	}
+	logger.Debug(fields)
+
+	tmpCmd := name + " "
+	for _, a := range args {
+		tmpCmd += a + " "
+	}
+	logger.Debug(Fields{"exec": tmpCmd})
+
+	cmd.Dir = g.cwd.String()
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.Output()
+
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if err != nil {
+			logger.Error(Fields{"": line})
+		} else {
+			logger.Debug(Fields{"": line})
+		}
+	}
+
+	lines := strings.Split(string(stdout), "\n")
+	return lines, err
+}
+
 // prepareGomobile installs gomobile into the gopath, if required
 func (g *Goup) prepareGomobile() error {
 	if g.goPath().Child("bin").Child("gomobile").Exists() {
@@ -290,10 +449,98 @@ func (g *Goup) prepareGomobile() error {
 	return nil
 }
 
-// copyModulesToWorkspace performs the heavy lifting to get gomobile happy with "modules".
-// It evaluates all module dependencies, collects them and copies the maximum resolved (by go mod vendor)
-// version into the workspace
+// copyModulesToWorkspace prepares the build workspace so that gomobile can bind the configured
+// modules. Modern gomobile versions work directly off a go.work file and no longer need a
+// synthetic GOPATH, so that is the default path. Set toolchain.legacyGopath: true in goup.yaml
+// to fall back to the old GOPATH copy for pre-module gomobile versions.
 func (g *Goup) copyModulesToWorkspace() error {
+	if g.config.Build.Gomobile.Toolchain.LegacyGopath {
+		return g.copyModulesToWorkspaceLegacy()
+	}
+	return g.writeGoWork()
+}
+
+// writeGoWork constructs a go.work file in the primary module's directory (the same directory
+// compileGomobile later chdirs into to invoke "bin/gomobile bind") referencing every module
+// declared in BuildGomobile.Modules, so that gomobile's own go command picks it up via its
+// regular working-directory discovery. GOWORK is also exported explicitly so this does not
+// depend on that discovery alone. Local modules are used as-is, remote modules are fetched first
+// via "go mod download -json" and then referenced by their resolved module cache directory.
+func (g *Goup) writeGoWork() error {
+	primary := g.primaryModuleDir()
+	g.chdir(primary)
+	g.setEnv("GO111MODULE", "on")
+
+	goWork := primary.Child("go.work")
+	if !goWork.Exists() {
+		_, err := g.Run("go", "work", "init")
+		if err != nil {
+			return fmt.Errorf("failed to init go.work: %v", err)
+		}
+	}
+
+	for _, modPath := range g.config.Build.Gomobile.Modules {
+		resolvedPath := Path(modPath).Resolve(g.args.BaseDir)
+
+		if !resolvedPath.Exists() {
+			// not a local module, fetch it so we have something to point go.work at
+			dir, err := g.downloadModule(string(modPath))
+			if err != nil {
+				return err
+			}
+			resolvedPath = dir
+		}
+
+		logger.Debug(Fields{"action": "use", "path": resolvedPath})
+		_, err := g.Run("go", "work", "use", resolvedPath.String())
+		if err != nil {
+			return fmt.Errorf("failed to add %s to go.work: %v", resolvedPath, err)
+		}
+	}
+
+	g.setEnv("GOWORK", goWork.String())
+
+	return nil
+}
+
+// downloadModule fetches a remote ModuleSpecifier via "go mod download -json" and returns the
+// directory it was placed in inside the module cache. "go mod download" requires an explicit
+// version, so @latest is assumed when modPath does not already carry a "@version" suffix.
+func (g *Goup) downloadModule(modPath string) (Path, error) {
+	query := modPath
+	if !strings.Contains(query, "@") {
+		query += "@latest"
+	}
+
+	lines, err := g.RunOutput("go", "mod", "download", "-json", query)
+	if err != nil {
+		return "", fmt.Errorf("failed to download module %s: %v", modPath, err)
+	}
+
+	var info struct {
+		Dir string
+	}
+	if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &info); err != nil || info.Dir == "" {
+		return "", fmt.Errorf("failed to parse module info for %s: %v", modPath, err)
+	}
+
+	return Path(info.Dir), nil
+}
+
+// primaryModuleDir returns the directory of the first configured module, which gomobile binds
+// from once GO111MODULE is on.
+func (g *Goup) primaryModuleDir() Path {
+	if len(g.config.Build.Gomobile.Modules) == 0 {
+		return g.goPath()
+	}
+	return Path(g.config.Build.Gomobile.Modules[0]).Resolve(g.args.BaseDir)
+}
+
+// copyModulesToWorkspaceLegacy performs the heavy lifting to get gomobile happy with "modules"
+// on gomobile versions that still require a synthetic GOPATH. It evaluates all module
+// dependencies, collects them and copies the maximum resolved (by go mod vendor) version into
+// the workspace.
+func (g *Goup) copyModulesToWorkspaceLegacy() error {
 	dependencies := make(map[string]VendoredModule)
 	g.chdir(g.goPath())
 	g.setEnv("GO111MODULE", "on")
@@ -407,55 +654,37 @@ func (g *Goup) hasTarget(target string) bool {
 
 // hasAndroidBuild returns true if a gomobile android section is defined and enabled
 func (g *Goup) hasAndroidBuild() bool {
-	return g.config.Build.Gomobile != nil || g.config.Build.Gomobile.Android != nil && g.hasTarget("gomobile/android")
+	return g.config.Build.Gomobile.Android != nil && g.hasTarget("gomobile/android")
 }
 
 // hasIosBuild returns true if a gomobile ios section is defined and enabled
 func (g *Goup) hasIosBuild() bool {
-	return g.config.Build.Gomobile != nil || g.config.Build.Gomobile.Ios != nil && g.hasTarget("gomobile/ios")
+	return g.config.Build.Gomobile.Ios != nil && g.hasTarget("gomobile/ios")
 }
 
 func (g *Goup) compileGomobile() error {
 	logger.Debug(Fields{"action": "compiling gomobile"})
-	g.chdir(g.goPath())
-	g.setEnv("GO111MODULE", "off")
+	if g.config.Build.Gomobile.Toolchain.LegacyGopath {
+		g.chdir(g.goPath())
+		g.setEnv("GO111MODULE", "off")
+	} else {
+		g.chdir(g.primaryModuleDir())
+		g.setEnv("GO111MODULE", "on")
+	}
 
 	if g.hasAndroidBuild() {
-		args := []string{"bind", "-v"}
-
 		outFile := g.config.Build.Gomobile.Android.Out.Resolve(g.args.BaseDir)
-		args = append(args, "-o", outFile.String())
-
-		if len(g.config.Build.Gomobile.Android.Javapkg) > 0 {
-			args = append(args, "-javapkg", g.config.Build.Gomobile.Android.Javapkg)
-		}
-		args = append(args, "-target=android")
-
-		args = append(args, g.config.Build.Gomobile.Export...)
-		_, err := g.Run("bin/gomobile", args...)
-		if err != nil {
+		if err := g.compileGomobileAndroid(outFile); err != nil {
 			return err
 		}
-
 	}
 
-	if g.hasIosBuild() {
-		args := []string{"bind", "-v"}
-
-		if len(g.config.Build.Gomobile.Ios.Out) == 0 {
-			g.config.Build.Gomobile.Ios.Out = Path("./" + g.config.Name + ".framework")
-		}
-		outFile := g.config.Build.Gomobile.Ios.Out.Resolve(g.args.BaseDir)
-		args = append(args, "-o", outFile.String())
-
-		if len(g.config.Build.Gomobile.Ios.Prefix) > 0 {
-			args = append(args, "-prefix", g.config.Build.Gomobile.Ios.Prefix)
+	if g.hasAppleBuild() {
+		if err := g.compileGomobileApple(); err != nil {
+			return err
 		}
-		args = append(args, "-target=ios")
-
-		args = append(args, g.config.Build.Gomobile.Export...)
-		_, err := g.Run("bin/gomobile", args...)
-		if err != nil {
+	} else if g.hasIosBuild() {
+		if err := g.compileGomobileIosLegacy(); err != nil {
 			return err
 		}
 	}
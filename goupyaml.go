@@ -36,8 +36,12 @@ type Build struct {
 type BuildGomobile struct {
 	// the toolchain section is required to setup a stable gomobile building experience
 	Toolchain BuildGomobileToolchain
-	// The ios section defines how our iOS library is build. This only works on MacOS with XCode installed
+	// The ios section defines how our iOS library is build. This only works on MacOS with XCode installed.
+	// Deprecated: use Apple instead, which can target more than just ios.
 	Ios *Ios
+	// The apple section builds an XCFramework bundling slices for every configured platform.
+	// This only works on MacOS with XCode installed
+	Apple *Apple
 	// The android section defines how our android build is executed
 	Android *Android
 
@@ -59,9 +63,26 @@ type BuildGomobileToolchain struct {
 	Ndk string
 	// which android sdk version? e.g. 4333796
 	Sdk string
+	// LegacyGopath switches copyModulesToWorkspace back to the synthetic GOPATH copy, for users
+	// still on a pre-module gomobile version. Newer gomobile versions work directly off a go.work
+	// file and no longer require this.
+	LegacyGopath bool
+
+	// GoPath points at an already installed go toolchain (its GOROOT). When set, goup skips
+	// downloading go and uses this path instead, after validating its version.
+	GoPath Path
+	// NdkPath points at an already installed Android NDK. When set, goup skips downloading the
+	// NDK and uses this path instead, after validating its version. Falls back to looking for
+	// the NDK under $ANDROID_HOME/ndk/<version> when unset.
+	NdkPath Path
+	// SdkPath points at an already installed Android SDK. When set, goup skips downloading the
+	// SDK and uses this path instead.
+	SdkPath Path
 }
 
 // The ios section defines how our iOS library is build. This only works on MacOS with XCode installed
+//
+// Deprecated: use Apple instead, which emits an XCFramework for an arbitrary set of platforms.
 type Ios struct {
 	// The gomobile -prefix flag
 	Prefix string
@@ -75,6 +96,27 @@ type Ios struct {
 	Disabled bool
 }
 
+// The apple section builds an XCFramework bundling slices for every platform in Platforms.
+// This only works on MacOS with XCode installed
+type Apple struct {
+	// Platforms lists the gomobile -target platforms to bundle into the XCFramework.
+	// Allowed values are ios, iossimulator, macos, maccatalyst, tvos and tvossimulator.
+	Platforms []string
+	// The gomobile -prefix flag
+	Prefix string
+	// The gomobile -o flag, this will be a .xcframework folder
+	Out Path
+	// The gomobile -bundleid flag sets the bundle ID to use with the app.
+	Bundleid string
+	// BundlePrefix is the reverse-DNS prefix used to derive Bundleid from config.Name when
+	// Bundleid is empty. Defaults to "org.goup".
+	BundlePrefix string
+	// The gomobile -ldflags flag
+	Ldflags string
+	// The disabled flag can be used to declare but disable this build
+	Disabled bool
+}
+
 // The android section defines how our android build is executed
 type Android struct {
 	// The gomobile -javapkg flag prefixes the generated packages
@@ -83,6 +125,12 @@ type Android struct {
 	Out Path
 	// The gomobile -ldflags flag
 	Ldflags string
+	// Archs restricts the -target=android/<arch> list to build. Valid values are
+	// arm, arm64, 386 and amd64. An empty list builds gomobile's default set.
+	Archs []string
+	// Parallel runs one gomobile bind per arch from Archs concurrently and merges the
+	// resulting AARs, instead of asking gomobile to build them all in a single serial invocation.
+	Parallel bool
 }
 
 // Load reads a build.yaml file into the receiver
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// main dispatches to the "gc" subcommand, or otherwise parses the regular build flags and
+// invokes the gomobile build for the current project.
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		runGC(os.Args[2:])
+		return
+	}
+
+	args := parseArgs(os.Args[1:])
+
+	gp, err := NewGoup(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := gp.Build(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runGC implements "goup gc <root>...": it removes any toolchain under ~/.goup/toolchains that
+// is no longer referenced by a goup.yaml found under the given project roots.
+func runGC(rootArgs []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	homeDir := fs.String("home-dir", defaultHomeDir(), "the goup home directory, e.g. ~/.goup")
+	must(fs.Parse(rootArgs))
+
+	roots := make([]Path, 0, len(fs.Args()))
+	for _, r := range fs.Args() {
+		roots = append(roots, Path(r))
+	}
+	if len(roots) == 0 {
+		roots = append(roots, Path("."))
+	}
+
+	if err := GC(Path(*homeDir), roots); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses the regular build flags into an Args
+func parseArgs(argv []string) *Args {
+	fs := flag.NewFlagSet("goup", flag.ExitOnError)
+	buildFile := fs.String("build-file", "goup.yaml", "path to the goup.yaml build file")
+	baseDir := fs.String("base-dir", ".", "the project base directory")
+	homeDir := fs.String("home-dir", defaultHomeDir(), "the goup home directory, e.g. ~/.goup")
+	resourcesURL := fs.String("resources-url", "https://raw.githubusercontent.com/chunkedswarm/goup/master/resources.xml", "url of the resources.xml catalog")
+	targets := fs.String("targets", "all", "comma separated list of targets to build, e.g. gomobile/android,gomobile/apple")
+	clearWorkspace := fs.Bool("clear-workspace", false, "remove the build workspace before starting")
+	must(fs.Parse(argv))
+
+	return &Args{
+		BuildFile:      Path(*buildFile),
+		BaseDir:        Path(*baseDir),
+		HomeDir:        Path(*homeDir),
+		ResourcesUrl:   *resourcesURL,
+		Targets:        strings.Split(*targets, ","),
+		ClearWorkspace: *clearWorkspace,
+	}
+}
+
+// defaultHomeDir returns ~/.goup
+func defaultHomeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".goup"
+	}
+	return home + "/.goup"
+}
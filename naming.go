@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// javaKeywords are reserved words that cannot be used as a Java package component, ported
+// from gomobile's build_test.go table.
+var javaKeywords = map[string]bool{
+	"abstract": true, "assert": true, "boolean": true, "break": true, "byte": true,
+	"case": true, "catch": true, "char": true, "class": true, "const": true,
+	"continue": true, "default": true, "do": true, "double": true, "else": true,
+	"enum": true, "extends": true, "final": true, "finally": true, "float": true,
+	"for": true, "goto": true, "if": true, "implements": true, "import": true,
+	"instanceof": true, "int": true, "interface": true, "long": true, "native": true,
+	"new": true, "package": true, "private": true, "protected": true, "public": true,
+	"return": true, "short": true, "static": true, "strictfp": true, "super": true,
+	"switch": true, "synchronized": true, "this": true, "throw": true, "throws": true,
+	"transient": true, "try": true, "void": true, "volatile": true, "while": true,
+}
+
+// defaultBundlePrefix is the reverse-DNS prefix used to derive a bundle id when neither
+// Apple.Bundleid nor Apple.BundlePrefix is configured.
+const defaultBundlePrefix = "org.goup"
+
+// appleBundleid returns Apple.Bundleid if set, otherwise derives one from config.Name as
+// "<BundlePrefix>.<rfc1034Label(Name)>".
+func (g *Goup) appleBundleid() string {
+	apple := g.config.Build.Gomobile.Apple
+	if len(apple.Bundleid) > 0 {
+		return apple.Bundleid
+	}
+	prefix := apple.BundlePrefix
+	if IsEmpty(prefix) {
+		prefix = defaultBundlePrefix
+	}
+	return prefix + "." + rfc1034Label(g.config.Name)
+}
+
+// iosBundleidLegacy returns Ios.Bundleid if set, otherwise derives one from config.Name the
+// same way as appleBundleid, for users still on the deprecated Ios section.
+func (g *Goup) iosBundleidLegacy() string {
+	ios := g.config.Build.Gomobile.Ios
+	if len(ios.Bundleid) > 0 {
+		return ios.Bundleid
+	}
+	return defaultBundlePrefix + "." + rfc1034Label(g.config.Name)
+}
+
+// androidJavapkg returns Android.Javapkg if set, otherwise derives one from config.Name.
+func (g *Goup) androidJavapkg() string {
+	android := g.config.Build.Gomobile.Android
+	if len(android.Javapkg) > 0 {
+		return android.Javapkg
+	}
+	return androidPkgName(g.config.Name)
+}
+
+// rfc1034Label sanitizes s into a valid RFC 1034 domain label: any character outside
+// [A-Za-z0-9-] is replaced with "-", and the result is forced to start with a letter.
+func rfc1034Label(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	label := b.String()
+	if label == "" || !unicode.IsLetter(rune(label[0])) {
+		label = "x-" + label
+	}
+	return label
+}
+
+// androidPkgName sanitizes s into a valid Java package component: any character that is not a
+// valid Java identifier character is replaced with "_", a leading digit is prefixed with "go",
+// and a name colliding with a Java keyword is suffixed with "_".
+func androidPkgName(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	name := b.String()
+	if name == "" {
+		return "go_"
+	}
+	if unicode.IsDigit(rune(name[0])) {
+		name = "go" + name
+	}
+	if javaKeywords[name] {
+		name += "_"
+	}
+	return name
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+// Ported from gomobile's build_test.go.
+func TestRFC1034Label(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", "x-"},
+		{"ascii", "hello-world", "hello-world"},
+		{"space", "My App", "My-App"},
+		{"emoji", "💩", "x--"},
+		{"leadingDigit", "123abc", "x-123abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rfc1034Label(tt.in); got != tt.want {
+				t.Errorf("rfc1034Label(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// Ported from gomobile's build_test.go.
+func TestAndroidPkgName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"ascii", "hello", "hello"},
+		{"space", "My App", "My_App"},
+		{"emoji", "💩", "_"},
+		{"leadingDigit", "123abc", "go123abc"},
+		{"keyword", "abstract", "abstract_"},
+		{"keywordSwitch", "switch", "switch_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := androidPkgName(tt.in); got != tt.want {
+				t.Errorf("androidPkgName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}